@@ -0,0 +1,34 @@
+// Package config holds job configuration types that are shared across
+// packages (endpoint, daemon control) and therefore don't belong to any
+// one of them.
+package config
+
+import (
+	"strings"
+
+	"github.com/zrepl/zrepl/internal/util/keysource"
+)
+
+// KeySourcesConfig maps a filesystem, or a filesystem-subtree prefix, to
+// the key provider config used to unlock (or, for a new encryption root,
+// set the key of) it. It is the job config's per-filesystem `keysources`
+// key.
+type KeySourcesConfig map[string]keysource.Config
+
+// Resolve returns the entry matching the longest configured prefix of fs,
+// e.g. an entry for "tank/backups" matches "tank/backups/db" but not
+// "tank/backups2". It returns false if no entry matches.
+func (m KeySourcesConfig) Resolve(fs string) (keysource.Config, bool) {
+	var bestPrefix string
+	var bestCfg keysource.Config
+	found := false
+	for prefix, cfg := range m {
+		if fs != prefix && !strings.HasPrefix(fs, prefix+"/") {
+			continue
+		}
+		if !found || len(prefix) > len(bestPrefix) {
+			bestPrefix, bestCfg, found = prefix, cfg, true
+		}
+	}
+	return bestCfg, found
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/zrepl/zrepl/internal/util/keysource"
+)
+
+func TestKeySourcesConfigResolve(t *testing.T) {
+	m := KeySourcesConfig{
+		"tank":         {Kind: keysource.KindFile, File: keysource.FileConfig{Path: "/root.key"}},
+		"tank/backups": {Kind: keysource.KindFile, File: keysource.FileConfig{Path: "/backups.key"}},
+	}
+
+	cases := []struct {
+		fs       string
+		wantPath string
+		wantOk   bool
+	}{
+		{"tank", "/root.key", true},
+		{"tank/other", "/root.key", true},
+		{"tank/backups", "/backups.key", true},
+		{"tank/backups/db", "/backups.key", true},
+		{"tank/backups2", "/root.key", true},
+		{"pool2/fs", "", false},
+	}
+
+	for _, c := range cases {
+		cfg, ok := m.Resolve(c.fs)
+		if ok != c.wantOk {
+			t.Errorf("Resolve(%q): ok = %v, want %v", c.fs, ok, c.wantOk)
+			continue
+		}
+		if ok && cfg.File.Path != c.wantPath {
+			t.Errorf("Resolve(%q): path = %q, want %q", c.fs, cfg.File.Path, c.wantPath)
+		}
+	}
+}
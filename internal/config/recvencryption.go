@@ -0,0 +1,16 @@
+package config
+
+import "github.com/zrepl/zrepl/internal/zfs"
+
+// RecvEncryptionConfig is a job's `recv.encryption` config key, selecting
+// how the receive side establishes encryption on the top-level received
+// filesystem: forwarding raw streams unchanged, creating a new encryption
+// root, or inheriting one from an existing parent.
+type RecvEncryptionConfig struct {
+	Mode zfs.RecvEncryptionMode `yaml:"mode"`
+	// New configures the encryption root ZFSCreateEncrypted establishes
+	// when Mode is RecvEncryptionNew. Ignored otherwise. Its KeySource
+	// field is never set from config; the receiver resolves it from
+	// KeySourcesConfig for the filesystem being created.
+	New zfs.EncryptionOptions `yaml:"new,omitempty"`
+}
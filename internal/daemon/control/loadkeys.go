@@ -0,0 +1,30 @@
+// Package control implements handlers for the zrepl daemon's control
+// socket, reachable via `zrepl signal ...`.
+package control
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/zrepl/zrepl/internal/config"
+	"github.com/zrepl/zrepl/internal/util/keysource"
+	"github.com/zrepl/zrepl/internal/zfs"
+)
+
+// LoadKeys serves the `zrepl signal load-keys JOB` control endpoint: it
+// loads the configured key for every filesystem in sources, letting an
+// operator unlock a job's encrypted destination datasets after a reboot
+// without restarting the daemon.
+func LoadKeys(ctx context.Context, sources config.KeySourcesConfig) error {
+	for fs, cfg := range sources {
+		provider, err := keysource.New(cfg)
+		if err != nil {
+			return errors.Wrapf(err, "load-keys: build key provider for %q", fs)
+		}
+		if err := zfs.ZFSLoadKey(ctx, fs, provider); err != nil {
+			return errors.Wrapf(err, "load-keys: %q", fs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package control
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zrepl/zrepl/internal/config"
+)
+
+func TestLoadKeysNoSourcesConfigured(t *testing.T) {
+	if err := LoadKeys(context.Background(), config.KeySourcesConfig{}); err != nil {
+		t.Errorf("LoadKeys with no configured sources should be a no-op, got: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+// Package keyrotation implements the staged ZFS encryption key rotation
+// exposed to operators as `zreplctl encryption rotate JOB`. The stage
+// names echo the prepare/rotate/reencrypt_active/reencrypt_finalize state
+// machine k3s uses for its own secrets-encryption rotation: each stage is
+// persisted before the next one starts, so an interrupted rotation
+// (daemon restart, operator ^C) resumes where it left off instead of
+// re-running from scratch.
+package keyrotation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/zrepl/zrepl/internal/zfs"
+	"github.com/zrepl/zrepl/internal/zfs/zfscmd"
+)
+
+// Stage identifies where a rotation is in its state machine.
+type Stage string
+
+const (
+	StagePrepare Stage = "prepare"
+	StageRotate  Stage = "rotate"
+	StageVerify  Stage = "verify"
+	StageCommit  Stage = "commit"
+	// StageFailed is a terminal state, not a resumable one: by the time
+	// verify can fail, StageRotate's `zfs change-key` has already taken
+	// effect and zfs has no "undo" for it, so there is nothing for Run to
+	// roll back. Recovery is manual: run `zfs change-key` on the root
+	// yourself with a known-correct passphrase to fix the wrapping key,
+	// then remove the state file at StatePath so the next Run starts a
+	// fresh rotation from StagePrepare.
+	StageFailed Stage = "failed"
+)
+
+// State is the on-disk record of an in-progress rotation.
+type State struct {
+	Job   string `json:"job"`
+	Root  string `json:"root"`
+	Stage Stage  `json:"stage"`
+}
+
+// Options configures a rotation run, mirroring the `zreplctl encryption
+// rotate JOB` flags.
+type Options struct {
+	// DryRun runs the prepare stage only and reports whether a rotation
+	// would proceed, without changing any key.
+	DryRun bool
+	// Skip excludes the named datasets from the prepare stage's
+	// keystatus check (e.g. known-offline replicas).
+	Skip map[string]bool
+}
+
+// StatePath returns the path a rotation for job persists its State under,
+// inside the daemon's state directory.
+func StatePath(stateDir, job string) string {
+	return stateDir + "/" + job + ".keyrotation.json"
+}
+
+// LoadState reads a persisted rotation State, or returns nil if no
+// rotation is in progress for that path.
+func LoadState(path string) (*State, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "keyrotation: read state")
+	}
+	var s State
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, errors.Wrap(err, "keyrotation: decode state")
+	}
+	return &s, nil
+}
+
+func saveState(path string, s *State) error {
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "keyrotation: encode state")
+	}
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		return errors.Wrap(err, "keyrotation: write state")
+	}
+	return nil
+}
+
+// Run performs, or resumes, a staged key rotation of the encryption root
+// at root, persisting progress to statePath after every stage transition.
+// Calling Run again with the same statePath after an interruption resumes
+// at the stage that was in flight.
+func Run(ctx context.Context, statePath, job, root string, newKey zfs.ChangeKeyOptions, opts Options) (err error) {
+	defer func(e *error) {
+		if *e != nil {
+			*e = fmt.Errorf("key rotation job=%q root=%q: %s", job, root, *e)
+		}
+	}(&err)
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &State{Job: job, Root: root, Stage: StagePrepare}
+	}
+	if state.Root != root {
+		return errors.Errorf("in-progress rotation at %q is for root %q, not %q", statePath, state.Root, root)
+	}
+	if state.Stage == StageFailed {
+		return errors.Errorf("rotation of %q previously failed verification: zfs change-key already took effect and cannot be rolled back automatically; run `zfs change-key` on %q yourself with a known-correct passphrase, then remove %q to start a fresh rotation", root, root, statePath)
+	}
+	// DryRun must refuse to resume a rotation that has already gone past
+	// StagePrepare: otherwise resuming here would run the real
+	// ZFSChangeKey (or later stages) while silently ignoring --dry-run.
+	if opts.DryRun && state.Stage != StagePrepare {
+		return errors.Errorf("cannot dry-run %q: a rotation is already in progress at stage %q; rerun without --dry-run to resume it, or inspect/clear %q first", root, state.Stage, statePath)
+	}
+
+	for {
+		switch state.Stage {
+		case StagePrepare:
+			if err := prepare(ctx, root, opts); err != nil {
+				return err
+			}
+			if opts.DryRun {
+				return nil
+			}
+			state.Stage = StageRotate
+		case StageRotate:
+			if err := zfs.ZFSChangeKey(ctx, root, newKey); err != nil {
+				return err
+			}
+			state.Stage = StageVerify
+		case StageVerify:
+			if err := verify(ctx, root, newKey); err != nil {
+				state.Stage = StageFailed
+				if serr := saveState(statePath, state); serr != nil {
+					return serr
+				}
+				return err
+			}
+			state.Stage = StageCommit
+		case StageCommit:
+			if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "clear state after commit")
+			}
+			return nil
+		default:
+			return errors.Errorf("unknown rotation stage %q", state.Stage)
+		}
+		if err := saveState(statePath, state); err != nil {
+			return err
+		}
+	}
+}
+
+// prepare verifies every non-skipped child of root has its key loaded
+// before any key is changed, refusing to start a rotation that would
+// otherwise leave some children unable to inherit the new key.
+func prepare(ctx context.Context, root string, opts Options) error {
+	children, err := childDatasets(ctx, root)
+	if err != nil {
+		return err
+	}
+	for _, fs := range children {
+		if opts.Skip[fs] {
+			continue
+		}
+		unloaded, err := zfs.ZFSGetKeyUnloaded(ctx, fs)
+		if err != nil {
+			return errors.Wrapf(err, "check key status of %q", fs)
+		}
+		if unloaded {
+			return errors.Errorf("cannot rotate %q: child %q has its key unloaded", root, fs)
+		}
+	}
+	return nil
+}
+
+// verify proves the key ZFSChangeKey just set actually works: `zfs
+// change-key` does not unload the key it replaces, so root's keystatus is
+// "available" immediately after StageRotate regardless of whether
+// newKey's passphrase was correct. To actually confirm decryption, verify
+// unloads root's key and reloads it using newKey.KeySource, the same
+// source the rotation just installed; only a matching passphrase will
+// bring keystatus back to "available".
+func verify(ctx context.Context, root string, newKey zfs.ChangeKeyOptions) error {
+	if newKey.Inherit {
+		// An inherited key was just proven to load by whatever rotation
+		// changed the parent; there is no new passphrase of our own to
+		// reload here.
+		return checkKeyAvailable(ctx, root)
+	}
+	if newKey.KeySource == nil {
+		return errors.New("cannot verify rotation: ChangeKeyOptions.KeySource is required to reload and confirm the new key")
+	}
+	if err := zfs.ZFSUnloadKey(ctx, root); err != nil {
+		return errors.Wrap(err, "unload key before verification")
+	}
+	if err := zfs.ZFSLoadKey(ctx, root, newKey.KeySource); err != nil {
+		return errors.Wrap(err, "reload key with newly rotated passphrase")
+	}
+	return checkKeyAvailable(ctx, root)
+}
+
+func checkKeyAvailable(ctx context.Context, root string) error {
+	unloaded, err := zfs.ZFSGetKeyUnloaded(ctx, root)
+	if err != nil {
+		return errors.Wrap(err, "check key status after rotation")
+	}
+	if unloaded {
+		return errors.New("key did not load successfully after rotation")
+	}
+	return nil
+}
+
+func childDatasets(ctx context.Context, root string) ([]string, error) {
+	cmd := zfscmd.CommandContext(ctx, "zfs", "list", "-r", "-H", "-o", "name", root)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "list children of %q: %s", root, string(output))
+	}
+	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
+}
@@ -0,0 +1,94 @@
+package keyrotation
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/zrepl/zrepl/internal/zfs"
+)
+
+func writeState(t *testing.T, path string, s *State) {
+	t.Helper()
+	if err := saveState(path, s); err != nil {
+		t.Fatalf("saveState: %v", err)
+	}
+}
+
+func TestLoadStateMissingFileReturnsNil(t *testing.T) {
+	dir := t.TempDir()
+	state, err := LoadState(filepath.Join(dir, "job.keyrotation.json"))
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if state != nil {
+		t.Errorf("expected nil state for a missing file, got %+v", state)
+	}
+}
+
+func TestSaveLoadStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := StatePath(dir, "myjob")
+	want := &State{Job: "myjob", Root: "tank", Stage: StageVerify}
+	writeState(t, path, want)
+
+	got, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if *got != *want {
+		t.Errorf("LoadState = %+v, want %+v", got, want)
+	}
+}
+
+func TestRunRefusesDryRunOverInProgressRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := StatePath(dir, "myjob")
+	writeState(t, path, &State{Job: "myjob", Root: "tank", Stage: StageRotate})
+
+	err := Run(context.Background(), path, "myjob", "tank", zfs.ChangeKeyOptions{}, Options{DryRun: true})
+	if err == nil {
+		t.Fatal("expected Run to refuse a --dry-run request while a real rotation is in progress")
+	}
+
+	// The in-progress state must be left untouched by the refusal.
+	state, loadErr := LoadState(path)
+	if loadErr != nil {
+		t.Fatalf("LoadState: %v", loadErr)
+	}
+	if state.Stage != StageRotate {
+		t.Errorf("state.Stage = %q, want unchanged %q", state.Stage, StageRotate)
+	}
+}
+
+func TestRunRefusesResumingFailedRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := StatePath(dir, "myjob")
+	writeState(t, path, &State{Job: "myjob", Root: "tank", Stage: StageFailed})
+
+	err := Run(context.Background(), path, "myjob", "tank", zfs.ChangeKeyOptions{}, Options{})
+	if err == nil {
+		t.Fatal("expected Run to always refuse resuming a rotation parked at StageFailed")
+	}
+
+	// The terminal state must be left untouched: there is no automatic
+	// recovery from it.
+	state, loadErr := LoadState(path)
+	if loadErr != nil {
+		t.Fatalf("LoadState: %v", loadErr)
+	}
+	if state.Stage != StageFailed {
+		t.Errorf("state.Stage = %q, want unchanged %q", state.Stage, StageFailed)
+	}
+}
+
+func TestRunRefusesMismatchedRoot(t *testing.T) {
+	dir := t.TempDir()
+	path := StatePath(dir, "myjob")
+	writeState(t, path, &State{Job: "myjob", Root: "tank/a", Stage: StagePrepare})
+
+	err := Run(context.Background(), path, "myjob", "tank/b", zfs.ChangeKeyOptions{}, Options{})
+	if err == nil {
+		t.Fatal("expected Run to refuse a root that doesn't match the in-progress rotation's root")
+	}
+}
@@ -0,0 +1,94 @@
+// Package endpoint contains the receive- and send-side logic that sits
+// between the RPC layer and the zfs package.
+package endpoint
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/zrepl/zrepl/internal/config"
+	"github.com/zrepl/zrepl/internal/util/keysource"
+	"github.com/zrepl/zrepl/internal/zfs"
+)
+
+// Receiver prepares a destination filesystem before `zfs recv` runs,
+// per a job's configured key sources and recv.encryption mode.
+type Receiver struct {
+	// KeySources resolves a destination filesystem to the key provider
+	// config used to unlock it.
+	KeySources config.KeySourcesConfig
+	// Recv is this job's `recv.encryption` config.
+	Recv config.RecvEncryptionConfig
+}
+
+// UnlockFilesystem loads fs's key if KeySources has an entry for it. It is
+// a no-op if no key source is configured for fs, leaving the existing
+// ZFSGetKeyUnloaded short-circuit to catch a still-locked destination.
+//
+// This must run before `zfs recv` into fs: receiving into a dataset whose
+// key is not loaded can corrupt it, see the bug referenced on
+// zfs.ZFSGetKeyUnloaded.
+func (r *Receiver) UnlockFilesystem(ctx context.Context, fs string) error {
+	cfg, ok := r.KeySources.Resolve(fs)
+	if !ok {
+		return nil
+	}
+	provider, err := keysource.New(cfg)
+	if err != nil {
+		return errors.Wrapf(err, "build key provider for %q", fs)
+	}
+	return zfs.ZFSLoadKey(ctx, fs, provider)
+}
+
+// PrepareTopLevelFilesystem establishes encryption on fs, the job's
+// receive prefix, before the first `zfs recv` into it, per r.Recv.Mode.
+// When opts.Raw was negotiated (both peers advertised EncryptionCaps.Raw,
+// see NegotiateSendOptions), this is always a no-op: a raw stream carries
+// fs as opaque ciphertext end-to-end, so the ZFSGetKeyUnloaded
+// short-circuit that the non-raw modes below rely on does not apply.
+//
+//   - RecvEncryptionRaw (or unset, for backwards compatibility): no-op,
+//     the raw stream is forwarded unchanged.
+//   - RecvEncryptionNew: creates fs as a new encryption root via
+//     zfs.ZFSCreateEncrypted, using the key source configured for fs. A
+//     no-op once fs is already its own encryption root, so a second
+//     replication cycle doesn't retry the one-time `zfs create`.
+//   - RecvEncryptionInherit: fs is expected to already be a child of an
+//     existing encryption root; this only unlocks it and validates that a
+//     non-raw stream may safely land on it.
+func (r *Receiver) PrepareTopLevelFilesystem(ctx context.Context, fs string, opts zfs.SendOptions) error {
+	if !zfs.ShouldCheckKeyUnloaded(opts) {
+		return nil
+	}
+	switch r.Recv.Mode {
+	case zfs.RecvEncryptionRaw, "":
+		return nil
+	case zfs.RecvEncryptionNew:
+		isRoot, err := zfs.IsOwnEncryptionRoot(ctx, fs)
+		if err != nil {
+			return err
+		}
+		if isRoot {
+			return nil
+		}
+		cfg, ok := r.KeySources.Resolve(fs)
+		if !ok {
+			return errors.Errorf("recv.encryption: mode %q requires a key source configured for %q", zfs.RecvEncryptionNew, fs)
+		}
+		provider, err := keysource.New(cfg)
+		if err != nil {
+			return errors.Wrapf(err, "build key provider for %q", fs)
+		}
+		opts := r.Recv.New
+		opts.KeySource = provider
+		return zfs.ZFSCreateEncrypted(ctx, fs, opts)
+	case zfs.RecvEncryptionInherit:
+		if err := r.UnlockFilesystem(ctx, fs); err != nil {
+			return err
+		}
+		return zfs.ValidateRecvInto(ctx, fs, r.Recv.Mode)
+	default:
+		return errors.Errorf("recv.encryption: unknown mode %q", r.Recv.Mode)
+	}
+}
@@ -0,0 +1,64 @@
+package endpoint
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zrepl/zrepl/internal/config"
+	"github.com/zrepl/zrepl/internal/zfs"
+)
+
+func TestPrepareTopLevelFilesystemRawIsNoop(t *testing.T) {
+	for _, mode := range []zfs.RecvEncryptionMode{zfs.RecvEncryptionRaw, ""} {
+		r := &Receiver{Recv: config.RecvEncryptionConfig{Mode: mode}}
+		if err := r.PrepareTopLevelFilesystem(context.Background(), "tank/recv", zfs.SendOptions{}); err != nil {
+			t.Errorf("mode %q: expected no-op, got error: %v", mode, err)
+		}
+	}
+}
+
+func TestPrepareTopLevelFilesystemUnknownMode(t *testing.T) {
+	r := &Receiver{Recv: config.RecvEncryptionConfig{Mode: "bogus"}}
+	if err := r.PrepareTopLevelFilesystem(context.Background(), "tank/recv", zfs.SendOptions{}); err == nil {
+		t.Error("expected an error for an unknown recv.encryption mode")
+	}
+}
+
+func TestPrepareTopLevelFilesystemNewRequiresKeySource(t *testing.T) {
+	r := &Receiver{Recv: config.RecvEncryptionConfig{Mode: zfs.RecvEncryptionNew}}
+	if err := r.PrepareTopLevelFilesystem(context.Background(), "tank/recv", zfs.SendOptions{}); err == nil {
+		t.Error("expected an error when no key source is configured for the new encryption root")
+	}
+}
+
+func TestPrepareTopLevelFilesystemSkippedWhenRaw(t *testing.T) {
+	// An unknown mode would normally error, but a negotiated raw
+	// transfer must short-circuit before the mode switch is even
+	// evaluated.
+	r := &Receiver{Recv: config.RecvEncryptionConfig{Mode: "bogus"}}
+	if err := r.PrepareTopLevelFilesystem(context.Background(), "tank/recv", zfs.SendOptions{Raw: true}); err != nil {
+		t.Errorf("raw transfer should skip preparation entirely, got error: %v", err)
+	}
+}
+
+func TestNegotiateSendOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		local   zfs.EncryptionCaps
+		peer    zfs.EncryptionCaps
+		wantRaw bool
+	}{
+		{"both support raw", zfs.EncryptionCaps{Raw: true}, zfs.EncryptionCaps{Raw: true}, true},
+		{"only local supports raw", zfs.EncryptionCaps{Raw: true}, zfs.EncryptionCaps{Raw: false}, false},
+		{"only peer supports raw", zfs.EncryptionCaps{Raw: false}, zfs.EncryptionCaps{Raw: true}, false},
+		{"neither supports raw", zfs.EncryptionCaps{}, zfs.EncryptionCaps{}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := NegotiateSendOptions(c.local, c.peer)
+			if got.Raw != c.wantRaw {
+				t.Errorf("NegotiateSendOptions(%+v, %+v).Raw = %v, want %v", c.local, c.peer, got.Raw, c.wantRaw)
+			}
+		})
+	}
+}
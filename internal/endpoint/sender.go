@@ -0,0 +1,35 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/zrepl/zrepl/internal/zfs"
+)
+
+// Sender is the send-side counterpart to Receiver: it probes this host's
+// EncryptionCaps and negotiates SendOptions with the peer's advertised
+// caps before any `zfs send` runs, so raw (zero-knowledge) replication of
+// an encrypted dataset is only attempted when both sides actually
+// support it.
+type Sender struct{}
+
+// NegotiateSendOptions combines this side's and the peer's probed
+// EncryptionCaps into the SendOptions a send should use. Raw is only set
+// when both sides advertise it; the RPC layer is expected to exchange
+// each side's EncryptionCaps (e.g. during the initial handshake) before
+// calling this, ahead of picking a resume token / stream type.
+func NegotiateSendOptions(local, peer zfs.EncryptionCaps) zfs.SendOptions {
+	return zfs.SendOptions{Raw: local.Raw && peer.Raw}
+}
+
+// PrepareSend probes this host's encryption caps and negotiates
+// SendOptions against peerCaps, as received from the peer over the RPC
+// layer, for a send of fs. When the result has Raw set, the caller must
+// skip `zfs load-key` for fs entirely and send it as opaque ciphertext.
+func (s *Sender) PrepareSend(ctx context.Context, fs string, peerCaps zfs.EncryptionCaps) (zfs.SendOptions, error) {
+	local, err := zfs.ProbeEncryptionCaps(ctx)
+	if err != nil {
+		return zfs.SendOptions{}, err
+	}
+	return NegotiateSendOptions(local, peerCaps), nil
+}
@@ -0,0 +1,256 @@
+// Package keysource provides pluggable sources for secrets (ZFS encryption
+// passphrases, zrepl state-encryption keys, ...) that are not supplied
+// directly in the zrepl config file.
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KeyProvider produces a secret on demand. Implementations must not cache
+// the secret beyond the lifetime of a single Get call; callers are
+// responsible for zeroing the returned slice once they are done with it.
+type KeyProvider interface {
+	Get(ctx context.Context) ([]byte, error)
+}
+
+// Kind identifies the provider implementation a Config selects.
+type Kind string
+
+const (
+	KindFile  Kind = "file"
+	KindExec  Kind = "exec"
+	KindHTTPS Kind = "https"
+	KindVault Kind = "vault"
+)
+
+// Config is the on-disk (YAML) representation of a KeyProvider. Exactly one
+// of the kind-specific sub-structs must be set, matching Kind.
+type Config struct {
+	Kind Kind `yaml:"kind"`
+
+	File  FileConfig  `yaml:"file,omitempty"`
+	Exec  ExecConfig  `yaml:"exec,omitempty"`
+	HTTPS HTTPSConfig `yaml:"https,omitempty"`
+	Vault VaultConfig `yaml:"vault,omitempty"`
+}
+
+// New constructs the KeyProvider described by cfg.
+func New(cfg Config) (KeyProvider, error) {
+	switch cfg.Kind {
+	case KindFile:
+		return newFileKeyProvider(cfg.File)
+	case KindExec:
+		return newExecKeyProvider(cfg.Exec)
+	case KindHTTPS:
+		return newHTTPSKeyProvider(cfg.HTTPS)
+	case KindVault:
+		return newVaultKeyProvider(cfg.Vault)
+	default:
+		return nil, errors.Errorf("keysource: unknown kind %q", cfg.Kind)
+	}
+}
+
+// FileConfig reads the secret from a local file, trimming a single
+// trailing newline if present (the common `echo $key > file` case).
+type FileConfig struct {
+	Path string `yaml:"path"`
+}
+
+type fileKeyProvider struct {
+	path string
+}
+
+func newFileKeyProvider(cfg FileConfig) (*fileKeyProvider, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("keysource file: `path` must not be empty")
+	}
+	return &fileKeyProvider{path: cfg.Path}, nil
+}
+
+func (p *fileKeyProvider) Get(ctx context.Context) ([]byte, error) {
+	raw, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "keysource file: read %q", p.path)
+	}
+	return bytes.TrimSuffix(raw, []byte("\n")), nil
+}
+
+// ExecConfig runs Command with Args and reads the secret from its stdout,
+// trimming a single trailing newline.
+type ExecConfig struct {
+	Command string        `yaml:"command"`
+	Args    []string      `yaml:"args,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+type execKeyProvider struct {
+	cfg ExecConfig
+}
+
+func newExecKeyProvider(cfg ExecConfig) (*execKeyProvider, error) {
+	if cfg.Command == "" {
+		return nil, errors.New("keysource exec: `command` must not be empty")
+	}
+	return &execKeyProvider{cfg: cfg}, nil
+}
+
+func (p *execKeyProvider) Get(ctx context.Context) ([]byte, error) {
+	if p.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, p.cfg.Command, p.cfg.Args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "keysource exec: run %q", p.cfg.Command)
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
+
+// HTTPSConfig fetches the secret from a URL, optionally pinning a CA
+// certificate and presenting a client certificate (mTLS), so the key can be
+// served from a host separate from the one holding the encrypted data.
+type HTTPSConfig struct {
+	URL        string        `yaml:"url"`
+	CACert     string        `yaml:"ca_cert,omitempty"`
+	ClientCert string        `yaml:"client_cert,omitempty"`
+	ClientKey  string        `yaml:"client_key,omitempty"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+}
+
+type httpsKeyProvider struct {
+	cfg    HTTPSConfig
+	client *http.Client
+}
+
+func newHTTPSKeyProvider(cfg HTTPSConfig) (*httpsKeyProvider, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("keysource https: `url` must not be empty")
+	}
+	tlsConfig := &tls.Config{}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "keysource https: read ca_cert %q", cfg.CACert)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("keysource https: no certificates found in ca_cert %q", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		return nil, errors.New("keysource https: `client_cert` and `client_key` must be set together")
+	}
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "keysource https: load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &httpsKeyProvider{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+func (p *httpsKeyProvider) Get(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "keysource https: build request")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "keysource https: fetch %q", p.cfg.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("keysource https: %q returned status %s", p.cfg.URL, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "keysource https: read response body")
+	}
+	return bytes.TrimSuffix(body, []byte("\n")), nil
+}
+
+// VaultConfig reads the secret from a HashiCorp Vault KV secret (or a KMIP
+// gateway fronted by the same HTTP API, as used by the ceph-csi KMS
+// integrations) at Address, using Token for authentication.
+type VaultConfig struct {
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+	// SecretPath is the full KV data path, e.g. "secret/data/zrepl/tank".
+	SecretPath string `yaml:"secret_path"`
+	// Field is the key within the secret's data map holding the passphrase.
+	Field   string        `yaml:"field"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+type vaultKeyProvider struct {
+	cfg    VaultConfig
+	client *http.Client
+}
+
+func newVaultKeyProvider(cfg VaultConfig) (*vaultKeyProvider, error) {
+	if cfg.Address == "" || cfg.SecretPath == "" || cfg.Field == "" {
+		return nil, errors.New("keysource vault: `address`, `secret_path` and `field` must all be set")
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &vaultKeyProvider{cfg: cfg, client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (p *vaultKeyProvider) Get(ctx context.Context) ([]byte, error) {
+	url := strings.TrimSuffix(p.cfg.Address, "/") + "/v1/" + strings.TrimPrefix(p.cfg.SecretPath, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "keysource vault: build request")
+	}
+	req.Header.Set("X-Vault-Token", p.cfg.Token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "keysource vault: fetch %q", p.cfg.SecretPath)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("keysource vault: %q returned status %s", p.cfg.SecretPath, resp.Status)
+	}
+	var parsed struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, errors.Wrap(err, "keysource vault: decode response")
+	}
+	val, ok := parsed.Data.Data[p.cfg.Field]
+	if !ok {
+		return nil, errors.Errorf("keysource vault: field %q not present in secret %q", p.cfg.Field, p.cfg.SecretPath)
+	}
+	return []byte(val), nil
+}
@@ -0,0 +1,84 @@
+package keysource
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileKeyProviderTrimsTrailingNewline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	provider, err := New(Config{Kind: KindFile, File: FileConfig{Path: path}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	got, err := provider.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(got) != "hunter2" {
+		t.Errorf("Get = %q, want %q", got, "hunter2")
+	}
+}
+
+func TestFileKeyProviderRejectsEmptyPath(t *testing.T) {
+	if _, err := New(Config{Kind: KindFile}); err == nil {
+		t.Fatal("expected an error for an empty file path")
+	}
+}
+
+func TestExecKeyProviderReadsStdout(t *testing.T) {
+	provider, err := New(Config{Kind: KindExec, Exec: ExecConfig{
+		Command: "printf",
+		Args:    []string{"%s", "swordfish\n"},
+	}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	got, err := provider.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(got) != "swordfish" {
+		t.Errorf("Get = %q, want %q", got, "swordfish")
+	}
+}
+
+func TestExecKeyProviderRejectsEmptyCommand(t *testing.T) {
+	if _, err := New(Config{Kind: KindExec}); err == nil {
+		t.Fatal("expected an error for an empty command")
+	}
+}
+
+func TestHTTPSKeyProviderRejectsEmptyURL(t *testing.T) {
+	if _, err := New(Config{Kind: KindHTTPS}); err == nil {
+		t.Fatal("expected an error for an empty URL")
+	}
+}
+
+func TestHTTPSKeyProviderRejectsMismatchedClientCertPair(t *testing.T) {
+	_, err := New(Config{Kind: KindHTTPS, HTTPS: HTTPSConfig{
+		URL:        "https://example.invalid/key",
+		ClientCert: "/tmp/cert.pem",
+	}})
+	if err == nil {
+		t.Fatal("expected an error when client_cert is set without client_key")
+	}
+}
+
+func TestVaultKeyProviderRejectsMissingFields(t *testing.T) {
+	if _, err := New(Config{Kind: KindVault}); err == nil {
+		t.Fatal("expected an error when address/secret_path/field are unset")
+	}
+}
+
+func TestNewRejectsUnknownKind(t *testing.T) {
+	if _, err := New(Config{Kind: "bogus"}); err == nil {
+		t.Fatal("expected an error for an unknown kind")
+	}
+}
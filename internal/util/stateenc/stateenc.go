@@ -0,0 +1,155 @@
+// Package stateenc provides application-level at-rest encryption for
+// zrepl's own state (replication cursors, bookmarks/holds metadata, cached
+// snapshot listings), independent of and in addition to ZFS native
+// encryption. It follows the envelope pattern external-dns uses for its
+// `--txt-encrypt-enabled` TXT records: AES-256-GCM, a fresh nonce per
+// record, and a versioned, key-id-tagged header so old and new keys both
+// decrypt during a rotation.
+package stateenc
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/zrepl/zrepl/internal/util/keysource"
+)
+
+// KeySize is the required length of an at-rest encryption key (AES-256).
+const KeySize = 32
+
+// headerVersion is Record.Version for the envelope format implemented by
+// this file. Bump it (and keep the old Open path around) if the envelope
+// ever changes shape.
+const headerVersion = 1
+
+// KeyID identifies one of the keys a KeyRing knows about, so a Record
+// sealed under a previous key remains decryptable during rotation.
+type KeyID string
+
+// Record is the versioned on-disk envelope for one encrypted value. The
+// GCM authentication tag is appended to Ciphertext by cipher.AEAD.Seal, so
+// it does not need its own field.
+type Record struct {
+	Version    int    `json:"version"`
+	KeyID      KeyID  `json:"kid"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// KeyRing resolves a KeyID to its key material, and knows which KeyID new
+// records should be sealed under.
+type KeyRing struct {
+	current KeyID
+	keys    map[KeyID][]byte
+}
+
+// NewKeyRing builds a KeyRing from keys (KeyID -> 32-byte key material),
+// sealing new records under current.
+func NewKeyRing(current KeyID, keys map[KeyID][]byte) (*KeyRing, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, errors.Errorf("stateenc: current key id %q not present in keys", current)
+	}
+	for kid, key := range keys {
+		if len(key) != KeySize {
+			return nil, errors.Errorf("stateenc: key %q must be %d bytes, got %d", kid, KeySize, len(key))
+		}
+	}
+	keysCopy := make(map[KeyID][]byte, len(keys))
+	for kid, key := range keys {
+		keysCopy[kid] = append([]byte(nil), key...)
+	}
+	return &KeyRing{current: current, keys: keysCopy}, nil
+}
+
+// LoadKey reads key material from source and rejects it unless it is
+// exactly KeySize bytes long. source may be backed by an inline config
+// value, a file, or any other keysource.KeyProvider, such as the ones
+// zfs.ZFSLoadKey uses for ZFS dataset key loading.
+func LoadKey(ctx context.Context, source keysource.KeyProvider) ([]byte, error) {
+	key, err := source.Get(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "stateenc: load key")
+	}
+	if len(key) != KeySize {
+		return nil, errors.Errorf("stateenc: key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext under the KeyRing's current key, authenticating
+// aad (typically the dataset name the record belongs to) alongside it.
+func (r *KeyRing) Seal(plaintext, aad []byte) (*Record, error) {
+	gcm, err := r.gcmFor(r.current)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "stateenc: generate nonce")
+	}
+	return &Record{
+		Version:    headerVersion,
+		KeyID:      r.current,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, aad),
+	}, nil
+}
+
+// Open decrypts rec, authenticating aad. rec.KeyID selects which of the
+// KeyRing's keys to use, so records sealed under a previous key remain
+// readable for the duration of a rotation.
+func (r *KeyRing) Open(rec *Record, aad []byte) ([]byte, error) {
+	if rec.Version != headerVersion {
+		return nil, errors.Errorf("stateenc: unsupported record version %d", rec.Version)
+	}
+	gcm, err := r.gcmFor(rec.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, rec.Nonce, rec.Ciphertext, aad)
+	if err != nil {
+		return nil, errors.Wrap(err, "stateenc: decrypt (wrong key or corrupt record)")
+	}
+	return plaintext, nil
+}
+
+// Rotate re-seals rec under the KeyRing's current key after decrypting it
+// under its existing KeyID. The documented rotation procedure is: install
+// the new key as current alongside the old one, call Rotate over every
+// stored record, then drop the old key id from the KeyRing once nothing
+// references it anymore.
+func (r *KeyRing) Rotate(rec *Record, aad []byte) (*Record, error) {
+	plaintext, err := r.Open(rec, aad)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(plaintext)
+	return r.Seal(plaintext, aad)
+}
+
+func (r *KeyRing) gcmFor(kid KeyID) (cipher.AEAD, error) {
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, errors.Errorf("stateenc: unknown key id %q", kid)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "stateenc: new cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "stateenc: new gcm")
+	}
+	return gcm, nil
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
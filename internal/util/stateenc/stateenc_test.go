@@ -0,0 +1,145 @@
+package stateenc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func testKeyRing(t *testing.T) *KeyRing {
+	t.Helper()
+	kr, err := NewKeyRing("k1", map[KeyID][]byte{
+		"k1": bytes.Repeat([]byte{0x01}, KeySize),
+	})
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	return kr
+}
+
+func TestNewKeyRingRejectsWrongKeySize(t *testing.T) {
+	_, err := NewKeyRing("k1", map[KeyID][]byte{"k1": []byte("too-short")})
+	if err == nil {
+		t.Fatal("expected an error for a key that isn't KeySize bytes")
+	}
+}
+
+func TestNewKeyRingRejectsUnknownCurrent(t *testing.T) {
+	_, err := NewKeyRing("missing", map[KeyID][]byte{"k1": bytes.Repeat([]byte{1}, KeySize)})
+	if err == nil {
+		t.Fatal("expected an error when current isn't present in keys")
+	}
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	kr := testKeyRing(t)
+	plaintext := []byte("bookmark cursor state")
+	aad := []byte("tank/dataset")
+
+	rec, err := kr.Seal(plaintext, aad)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if rec.KeyID != "k1" {
+		t.Errorf("rec.KeyID = %q, want %q", rec.KeyID, "k1")
+	}
+
+	got, err := kr.Open(rec, aad)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Open = %q, want %q", got, plaintext)
+	}
+}
+
+func TestOpenRejectsWrongAAD(t *testing.T) {
+	kr := testKeyRing(t)
+	rec, err := kr.Seal([]byte("secret"), []byte("tank/a"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if _, err := kr.Open(rec, []byte("tank/b")); err == nil {
+		t.Fatal("expected Open to fail when aad doesn't match what was sealed")
+	}
+}
+
+func TestOpenRejectsTamperedCiphertext(t *testing.T) {
+	kr := testKeyRing(t)
+	rec, err := kr.Seal([]byte("secret"), []byte("tank/a"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	rec.Ciphertext[0] ^= 0xff
+	if _, err := kr.Open(rec, []byte("tank/a")); err == nil {
+		t.Fatal("expected Open to fail on tampered ciphertext")
+	}
+}
+
+func TestOpenRejectsUnknownKeyID(t *testing.T) {
+	kr := testKeyRing(t)
+	rec, err := kr.Seal([]byte("secret"), []byte("tank/a"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	rec.KeyID = "does-not-exist"
+	if _, err := kr.Open(rec, []byte("tank/a")); err == nil {
+		t.Fatal("expected Open to fail for an unknown key id")
+	}
+}
+
+func TestRotateReKeysAndOldKeyStaysReadable(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{0x01}, KeySize)
+	newKey := bytes.Repeat([]byte{0x02}, KeySize)
+
+	before, err := NewKeyRing("old", map[KeyID][]byte{"old": oldKey})
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	aad := []byte("tank/dataset")
+	rec, err := before.Seal([]byte("bookmark cursor state"), aad)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	// During rollover both keys are present, with "new" selected for new
+	// records.
+	during, err := NewKeyRing("new", map[KeyID][]byte{"old": oldKey, "new": newKey})
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+
+	rotated, err := during.Rotate(rec, aad)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if rotated.KeyID != "new" {
+		t.Errorf("rotated.KeyID = %q, want %q", rotated.KeyID, "new")
+	}
+
+	got, err := during.Open(rotated, aad)
+	if err != nil {
+		t.Fatalf("Open rotated record: %v", err)
+	}
+	if string(got) != "bookmark cursor state" {
+		t.Errorf("Open rotated record = %q, want original plaintext", got)
+	}
+
+	// The un-rotated record, still under "old", must remain decryptable
+	// until every record has been rotated and "old" is dropped.
+	if _, err := during.Open(rec, aad); err != nil {
+		t.Errorf("Open original record under retained old key: %v", err)
+	}
+}
+
+func TestLoadKeyRejectsWrongSize(t *testing.T) {
+	if _, err := LoadKey(context.Background(), stubProvider{[]byte("short")}); err == nil {
+		t.Fatal("expected LoadKey to reject a key that isn't KeySize bytes")
+	}
+}
+
+type stubProvider struct{ key []byte }
+
+func (s stubProvider) Get(ctx context.Context) ([]byte, error) {
+	return s.key, nil
+}
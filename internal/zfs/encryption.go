@@ -1,6 +1,7 @@
 package zfs
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os/exec"
@@ -10,6 +11,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/zrepl/zrepl/internal/util/envconst"
+	"github.com/zrepl/zrepl/internal/util/keysource"
 	"github.com/zrepl/zrepl/internal/zfs/zfscmd"
 )
 
@@ -105,3 +107,57 @@ func ZFSGetKeyUnloaded(ctx context.Context, fs string) (loaded bool, err error)
 		panic("Unknown key status")
 	}
 }
+
+// ZFSLoadKey loads the wrapping key for fs from source and runs `zfs
+// load-key`, unlocking fs for `zfs recv` / mount. It is a no-op if the key
+// is already available.
+//
+// Loading the key before `zfs recv` is not just an optimization: receiving
+// into a dataset whose key is not loaded can corrupt it, see the bug
+// referenced on ZFSGetKeyUnloaded.
+func ZFSLoadKey(ctx context.Context, fs string, source keysource.KeyProvider) (err error) {
+	defer func(e *error) {
+		if *e != nil {
+			*e = fmt.Errorf("zfs load-key fs=%q: %s", fs, *e)
+		}
+	}(&err)
+
+	if supp, err := EncryptionCLISupported(ctx); err != nil {
+		return err
+	} else if !supp {
+		return errors.New("native encryption is not supported by the zfs CLI on this host")
+	}
+
+	if err := validateZFSFilesystem(fs); err != nil {
+		return err
+	}
+
+	unloaded, err := ZFSGetKeyUnloaded(ctx, fs)
+	if err != nil {
+		return errors.Wrap(err, "cannot determine key status")
+	}
+	if !unloaded {
+		return nil
+	}
+
+	passphrase, err := source.Get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot obtain key from key source")
+	}
+	defer zeroBytes(passphrase)
+
+	cmd := zfscmd.CommandContext(ctx, "zfs", "load-key", fs)
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s", string(output))
+	}
+	return nil
+}
+
+// zeroBytes overwrites b in place, best-effort scrubbing of a passphrase
+// from memory once it is no longer needed.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,84 @@
+package zfs
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/zrepl/zrepl/internal/zfs/zfscmd"
+)
+
+// EncryptionCaps describes the native-encryption related capabilities of
+// the zfs CLI / kernel module on one side of a replication (sender or
+// receiver). It supersedes the plain bool returned by EncryptionCLISupported
+// for anything that needs to negotiate a raw transfer with a peer.
+type EncryptionCaps struct {
+	// Raw indicates `zfs send -w` (raw send) and raw receive are
+	// supported, i.e. an encrypted dataset can be replicated without
+	// either side loading its key.
+	Raw bool
+	// EmbeddedData indicates `zfs send -e` is supported.
+	EmbeddedData bool
+	// LargeBlocks indicates `zfs send -L` is supported.
+	LargeBlocks bool
+	// KeyLoad indicates `zfs load-key` is supported. Equivalent to what
+	// EncryptionCLISupported reported before EncryptionCaps existed.
+	KeyLoad bool
+}
+
+var encryptionCaps struct {
+	once sync.Once
+	caps EncryptionCaps
+	err  error
+}
+
+// ProbeEncryptionCaps probes the local zfs CLI's encryption-related send
+// flags once per process and caches the result. Use this instead of
+// EncryptionCLISupported when deciding whether a raw / zero-knowledge
+// transfer can be negotiated with a peer.
+func ProbeEncryptionCaps(ctx context.Context) (EncryptionCaps, error) {
+	encryptionCaps.once.Do(func() {
+		keyLoadSupported, err := EncryptionCLISupported(ctx)
+		if err != nil {
+			encryptionCaps.err = errors.Wrap(err, "probe key-load support")
+			return
+		}
+
+		cmd := zfscmd.CommandContext(ctx, "zfs", "send")
+		output, err := cmd.CombinedOutput()
+		if ee, ok := err.(*exec.ExitError); !ok || ok && !ee.Exited() {
+			encryptionCaps.err = errors.Wrap(err, "zfs send feature check failed")
+			return
+		}
+		help := string(output)
+
+		encryptionCaps.caps = EncryptionCaps{
+			Raw:          keyLoadSupported && strings.Contains(help, "-w"),
+			EmbeddedData: strings.Contains(help, "-e"),
+			LargeBlocks:  strings.Contains(help, "-L"),
+			KeyLoad:      keyLoadSupported,
+		}
+		debug("encryption caps probe complete %#v", &encryptionCaps.caps)
+	})
+	return encryptionCaps.caps, encryptionCaps.err
+}
+
+// SendOptions controls how a `zfs send` invocation is built. Raw is set
+// once both replication peers' EncryptionCaps advertise Raw support; the
+// RPC layer negotiates it before a resume token / stream type is chosen,
+// and it is intentionally independent of whether the sender itself has the
+// dataset's key loaded.
+type SendOptions struct {
+	Raw bool
+}
+
+// ShouldCheckKeyUnloaded reports whether a caller about to send or receive
+// fs should consult ZFSGetKeyUnloaded at all. A raw transfer carries the
+// dataset as opaque ciphertext end-to-end, so neither the sender's
+// `zfs load-key` nor the receiver's ZFSGetKeyUnloaded short-circuit apply.
+func ShouldCheckKeyUnloaded(opts SendOptions) bool {
+	return !opts.Raw
+}
@@ -0,0 +1,114 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/zrepl/zrepl/internal/util/keysource"
+	"github.com/zrepl/zrepl/internal/zfs/zfscmd"
+)
+
+// ChangeKeyOptions configures a `zfs change-key` invocation: either
+// Inherit, to adopt the parent dataset's encryption key (`-i`), or a new
+// keyformat/keylocation/pbkdf2iters triple establishing fs as its own
+// encryption root going forward.
+type ChangeKeyOptions struct {
+	// Inherit runs `zfs change-key -i`, making fs inherit its parent's
+	// key instead of being its own encryption root. All other fields are
+	// ignored when Inherit is set.
+	Inherit bool
+
+	KeyFormat   string
+	KeyLocation string
+	KeySource   keysource.KeyProvider
+	PBKDF2Iters int
+}
+
+// ZFSChangeKey runs `zfs change-key` on fs per opts. fs must already be an
+// encryption root (or becoming one via Inherit=false) with its key loaded.
+func ZFSChangeKey(ctx context.Context, fs string, opts ChangeKeyOptions) (err error) {
+	defer func(e *error) {
+		if *e != nil {
+			*e = fmt.Errorf("zfs change-key fs=%q: %s", fs, *e)
+		}
+	}(&err)
+
+	if supp, err := EncryptionCLISupported(ctx); err != nil {
+		return err
+	} else if !supp {
+		return errors.New("native encryption is not supported by the zfs CLI on this host")
+	}
+
+	if err := validateZFSFilesystem(fs); err != nil {
+		return err
+	}
+
+	if opts.Inherit {
+		cmd := zfscmd.CommandContext(ctx, "zfs", "change-key", "-i", fs)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "%s", string(output))
+		}
+		return nil
+	}
+
+	if opts.KeyFormat == "" {
+		return errors.New("ChangeKeyOptions: KeyFormat must be set unless Inherit")
+	}
+	keyLocation := opts.KeyLocation
+	if keyLocation == "" {
+		keyLocation = "prompt"
+	}
+
+	args := []string{"change-key", "-o", "keyformat=" + opts.KeyFormat, "-o", "keylocation=" + keyLocation}
+	if opts.PBKDF2Iters > 0 {
+		args = append(args, "-o", "pbkdf2iters="+strconv.Itoa(opts.PBKDF2Iters))
+	}
+	args = append(args, fs)
+	cmd := zfscmd.CommandContext(ctx, "zfs", args...)
+
+	if opts.KeySource != nil && keyLocation == "prompt" {
+		passphrase, err := opts.KeySource.Get(ctx)
+		if err != nil {
+			return errors.Wrap(err, "cannot obtain key from key source")
+		}
+		defer zeroBytes(passphrase)
+		cmd.SetStdin(bytes.NewReader(passphrase))
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s", string(output))
+	}
+	return nil
+}
+
+// ZFSUnloadKey runs `zfs unload-key` on fs, discarding its in-memory
+// wrapping key. It is primarily useful to prove a key was set correctly:
+// unload it, then ZFSLoadKey with the candidate passphrase and check
+// ZFSGetKeyUnloaded again.
+func ZFSUnloadKey(ctx context.Context, fs string) (err error) {
+	defer func(e *error) {
+		if *e != nil {
+			*e = fmt.Errorf("zfs unload-key fs=%q: %s", fs, *e)
+		}
+	}(&err)
+
+	if supp, err := EncryptionCLISupported(ctx); err != nil {
+		return err
+	} else if !supp {
+		return errors.New("native encryption is not supported by the zfs CLI on this host")
+	}
+
+	if err := validateZFSFilesystem(fs); err != nil {
+		return err
+	}
+
+	cmd := zfscmd.CommandContext(ctx, "zfs", "unload-key", fs)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s", string(output))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/zrepl/zrepl/internal/util/keysource"
+	"github.com/zrepl/zrepl/internal/zfs/zfscmd"
+)
+
+// RecvEncryptionMode selects how a replication job establishes encryption
+// on the receive side's top-level dataset. It is configured per job via
+// the `recv.encryption` config key.
+type RecvEncryptionMode string
+
+const (
+	// RecvEncryptionInherit receives into a child of an already-existing
+	// encryption root; no encryption properties are passed to `zfs recv`.
+	RecvEncryptionInherit RecvEncryptionMode = "inherit"
+	// RecvEncryptionRaw forwards raw (`zfs send -w`) streams unchanged;
+	// the receive side never sees plaintext or the wrapping key.
+	RecvEncryptionRaw RecvEncryptionMode = "raw"
+	// RecvEncryptionNew creates the receive prefix as a new encryption
+	// root using EncryptionOptions before the first receive into it.
+	RecvEncryptionNew RecvEncryptionMode = "new"
+)
+
+// EncryptionOptions configures a new ZFS native encryption root, i.e. the
+// `encryption` / `keyformat` / `keylocation` / `pbkdf2iters` properties
+// passed to `zfs create`. Its fields (other than KeySource) are the
+// `recv.encryption.new` job config keys.
+type EncryptionOptions struct {
+	// Cipher is the `encryption` property, e.g. "aes-256-gcm". Empty
+	// means "on", letting zfs pick its default cipher suite.
+	Cipher string `yaml:"cipher,omitempty"`
+	// KeyFormat is the `keyformat` property: "passphrase", "hex" or "raw".
+	KeyFormat string `yaml:"keyformat"`
+	// KeyLocation is the `keylocation` property. Empty defaults to
+	// "prompt", in which case KeySource (if set) is used to supply the
+	// key on create's stdin instead of requiring an interactive prompt.
+	KeyLocation string `yaml:"keylocation,omitempty"`
+	// KeySource supplies the passphrase on create's stdin; it is resolved
+	// from the job's `keysources` config (see config.KeySourcesConfig),
+	// not set directly from `recv.encryption.new`.
+	KeySource keysource.KeyProvider `yaml:"-"`
+	// PBKDF2Iters is the `pbkdf2iters` property. Zero leaves it at the
+	// zfs default.
+	PBKDF2Iters int `yaml:"pbkdf2iters,omitempty"`
+}
+
+func (o EncryptionOptions) createProps() ([]string, error) {
+	if o.KeyFormat == "" {
+		return nil, errors.New("EncryptionOptions: KeyFormat must be set")
+	}
+	cipher := o.Cipher
+	if cipher == "" {
+		cipher = "on"
+	}
+	keyLocation := o.KeyLocation
+	if keyLocation == "" {
+		keyLocation = "prompt"
+	}
+	props := []string{
+		"-o", "encryption=" + cipher,
+		"-o", "keyformat=" + o.KeyFormat,
+		"-o", "keylocation=" + keyLocation,
+	}
+	if o.PBKDF2Iters > 0 {
+		props = append(props, "-o", "pbkdf2iters="+strconv.Itoa(o.PBKDF2Iters))
+	}
+	return props, nil
+}
+
+// ZFSCreateEncrypted creates fs as a new ZFS native encryption root per
+// opts, mirroring the pattern of creating a dedicated encryption root for
+// each top-level dataset rather than inheriting one from the pool root.
+func ZFSCreateEncrypted(ctx context.Context, fs string, opts EncryptionOptions) (err error) {
+	defer func(e *error) {
+		if *e != nil {
+			*e = fmt.Errorf("zfs create encrypted fs=%q: %s", fs, *e)
+		}
+	}(&err)
+
+	if supp, err := EncryptionCLISupported(ctx); err != nil {
+		return err
+	} else if !supp {
+		return errors.New("native encryption is not supported by the zfs CLI on this host")
+	}
+
+	if err := validateZFSFilesystem(fs); err != nil {
+		return err
+	}
+
+	props, err := opts.createProps()
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"create"}, props...)
+	args = append(args, fs)
+	cmd := zfscmd.CommandContext(ctx, "zfs", args...)
+
+	promptsForKey := opts.KeyLocation == "" || opts.KeyLocation == "prompt"
+	if opts.KeySource != nil && promptsForKey {
+		passphrase, err := opts.KeySource.Get(ctx)
+		if err != nil {
+			return errors.Wrap(err, "cannot obtain key from key source")
+		}
+		defer zeroBytes(passphrase)
+		cmd.SetStdin(bytes.NewReader(passphrase))
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s", string(output))
+	}
+	return nil
+}
+
+// IsOwnEncryptionRoot reports whether fs already exists and is its own
+// encryption root. PrepareTopLevelFilesystem uses this to make
+// RecvEncryptionNew idempotent across replication cycles: `zfs create`
+// only succeeds the first time a job's receive prefix is established, so
+// later cycles must skip ZFSCreateEncrypted instead of failing with
+// "dataset already exists".
+func IsOwnEncryptionRoot(ctx context.Context, fs string) (ok bool, err error) {
+	defer func(e *error) {
+		if *e != nil {
+			*e = fmt.Errorf("check encryption root fs=%q: %s", fs, *e)
+		}
+	}(&err)
+
+	if supp, err := EncryptionCLISupported(ctx); err != nil {
+		return false, err
+	} else if !supp {
+		return false, nil
+	}
+	if err := validateZFSFilesystem(fs); err != nil {
+		return false, err
+	}
+
+	cmd := zfscmd.CommandContext(ctx, "zfs", "get", "-H", "-o", "value", "encryptionroot", fs)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if bytes.Contains(output, []byte("dataset does not exist")) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "%s", string(output))
+	}
+	return strings.TrimSpace(string(output)) == fs, nil
+}
+
+// ValidateRecvInto checks that fs may receive a stream under mode without
+// risking the corruption documented on ZFSGetKeyUnloaded: a non-raw stream
+// must never be received into an encryption root (or a child of one)
+// whose key is not currently loaded.
+func ValidateRecvInto(ctx context.Context, fs string, mode RecvEncryptionMode) error {
+	if mode == RecvEncryptionRaw {
+		return nil
+	}
+	unloaded, err := ZFSGetKeyUnloaded(ctx, fs)
+	if err != nil {
+		return errors.Wrap(err, "cannot check whether encryption root key is loaded")
+	}
+	if unloaded {
+		return errors.Errorf("refusing to receive a non-raw stream into %q: encryption root key is not loaded", fs)
+	}
+	return nil
+}
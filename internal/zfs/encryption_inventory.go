@@ -0,0 +1,99 @@
+package zfs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/zrepl/zrepl/internal/zfs/zfscmd"
+)
+
+// DatasetEncryptionInfo is one dataset's encryption-related properties, as
+// returned by ZFSEncryptionInventory.
+type DatasetEncryptionInfo struct {
+	Encryption     string
+	KeyStatus      string
+	KeyFormat      string
+	EncryptionRoot string
+	PBKDF2Iters    int
+}
+
+// Enabled reports whether the dataset has native encryption turned on.
+func (i DatasetEncryptionInfo) Enabled() bool {
+	return i.Encryption != "" && i.Encryption != "off" && i.Encryption != "-"
+}
+
+// KeyAvailable reports whether the dataset's key is currently loaded.
+func (i DatasetEncryptionInfo) KeyAvailable() bool {
+	return i.KeyStatus == "available"
+}
+
+// ZFSEncryptionInventory returns the encryption-related properties of root
+// and every descendant dataset via a single `zfs get -r`, replacing what
+// would otherwise be one `zfs get` fork/exec per dataset per call to
+// ZFSGetEncryptionEnabled / ZFSGetKeyUnloaded.
+func ZFSEncryptionInventory(ctx context.Context, root string) (map[string]DatasetEncryptionInfo, error) {
+	if supp, err := EncryptionCLISupported(ctx); err != nil {
+		return nil, err
+	} else if !supp {
+		return nil, nil
+	}
+	if err := validateZFSFilesystem(root); err != nil {
+		return nil, err
+	}
+
+	props := strings.Join([]string{"encryption", "keystatus", "keyformat", "encryptionroot", "pbkdf2iters"}, ",")
+	cmd := zfscmd.CommandContext(ctx, "zfs", "get", "-r", "-H", "-o", "name,property,value", props, root)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "zfs encryption inventory root=%q: %s", root, string(output))
+	}
+
+	inventory, err := parseEncryptionInventory(output)
+	if err != nil {
+		return nil, errors.Wrapf(err, "zfs encryption inventory root=%q", root)
+	}
+	return inventory, nil
+}
+
+// parseEncryptionInventory parses the tab-separated `name,property,value`
+// lines produced by `zfs get -r -H -o name,property,value <props> <root>`
+// into a DatasetEncryptionInfo per dataset.
+func parseEncryptionInventory(output []byte) (map[string]DatasetEncryptionInfo, error) {
+	inventory := make(map[string]DatasetEncryptionInfo)
+	trimmed := strings.TrimRight(string(output), "\n")
+	if trimmed == "" {
+		return inventory, nil
+	}
+	for _, line := range strings.Split(trimmed, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+		name, property, value := fields[0], fields[1], fields[2]
+		info := inventory[name]
+		switch property {
+		case "encryption":
+			info.Encryption = value
+		case "keystatus":
+			info.KeyStatus = value
+		case "keyformat":
+			info.KeyFormat = value
+		case "encryptionroot":
+			info.EncryptionRoot = value
+		case "pbkdf2iters":
+			if value != "-" {
+				iters, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "parse pbkdf2iters %q", value)
+				}
+				info.PBKDF2Iters = iters
+			}
+		}
+		inventory[name] = info
+	}
+	return inventory, nil
+}
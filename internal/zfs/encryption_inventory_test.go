@@ -0,0 +1,70 @@
+package zfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEncryptionInventory(t *testing.T) {
+	output := "tank\tencryption\taes-256-gcm\n" +
+		"tank\tkeystatus\tavailable\n" +
+		"tank\tkeyformat\tpassphrase\n" +
+		"tank\tencryptionroot\ttank\n" +
+		"tank\tpbkdf2iters\t350000\n" +
+		"tank/child\tencryption\taes-256-gcm\n" +
+		"tank/child\tkeystatus\tavailable\n" +
+		"tank/child\tkeyformat\t-\n" +
+		"tank/child\tencryptionroot\ttank\n" +
+		"tank/child\tpbkdf2iters\t-\n" +
+		"tank/plain\tencryption\toff\n" +
+		"tank/plain\tkeystatus\t-\n" +
+		"tank/plain\tkeyformat\t-\n" +
+		"tank/plain\tencryptionroot\t-\n" +
+		"tank/plain\tpbkdf2iters\t-\n"
+
+	got, err := parseEncryptionInventory([]byte(output))
+	if err != nil {
+		t.Fatalf("parseEncryptionInventory: %v", err)
+	}
+
+	want := map[string]DatasetEncryptionInfo{
+		"tank": {
+			Encryption: "aes-256-gcm", KeyStatus: "available", KeyFormat: "passphrase",
+			EncryptionRoot: "tank", PBKDF2Iters: 350000,
+		},
+		"tank/child": {
+			Encryption: "aes-256-gcm", KeyStatus: "available", KeyFormat: "-",
+			EncryptionRoot: "tank", PBKDF2Iters: 0,
+		},
+		"tank/plain": {
+			Encryption: "off", KeyStatus: "-", KeyFormat: "-",
+			EncryptionRoot: "-", PBKDF2Iters: 0,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseEncryptionInventory =\n%+v\nwant\n%+v", got, want)
+	}
+
+	if !got["tank"].Enabled() || !got["tank"].KeyAvailable() {
+		t.Error("tank should report Enabled() and KeyAvailable()")
+	}
+	if got["tank/plain"].Enabled() {
+		t.Error("tank/plain has encryption=off, should not report Enabled()")
+	}
+}
+
+func TestParseEncryptionInventoryEmpty(t *testing.T) {
+	got, err := parseEncryptionInventory([]byte(""))
+	if err != nil {
+		t.Fatalf("parseEncryptionInventory: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected an empty inventory, got %+v", got)
+	}
+}
+
+func TestParseEncryptionInventoryMalformedLine(t *testing.T) {
+	if _, err := parseEncryptionInventory([]byte("tank\tencryption\n")); err == nil {
+		t.Error("expected an error for a line missing the value field")
+	}
+}
@@ -0,0 +1,62 @@
+package zfs
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// EncryptionMetrics holds the Prometheus gauges populated by Record, one
+// series per dataset name. Register it with the daemon's global
+// prometheus.Registerer once at startup; call Record after each
+// ZFSEncryptionInventory call to refresh the series, so operators can
+// alert on a key that silently unloaded between replication runs instead
+// of only finding out when the next send/recv fails.
+type EncryptionMetrics struct {
+	Enabled        *prometheus.GaugeVec
+	KeyAvailable   *prometheus.GaugeVec
+	EncryptionRoot *prometheus.GaugeVec
+}
+
+// NewEncryptionMetrics constructs the gauge vectors backing
+// zrepl_zfs_encryption_enabled, zrepl_zfs_key_available and
+// zrepl_zfs_encryption_root.
+func NewEncryptionMetrics() *EncryptionMetrics {
+	return &EncryptionMetrics{
+		Enabled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "zrepl_zfs_encryption_enabled",
+			Help: "1 if the dataset has native ZFS encryption enabled, 0 otherwise",
+		}, []string{"ds"}),
+		KeyAvailable: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "zrepl_zfs_key_available",
+			Help: "1 if the dataset's encryption key is currently loaded, 0 otherwise",
+		}, []string{"ds"}),
+		EncryptionRoot: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "zrepl_zfs_encryption_root",
+			Help: "1 if the dataset is its own encryption root, 0 otherwise",
+		}, []string{"ds"}),
+	}
+}
+
+// Register registers all of m's collectors with reg.
+func (m *EncryptionMetrics) Register(reg prometheus.Registerer) {
+	reg.MustRegister(m.Enabled, m.KeyAvailable, m.EncryptionRoot)
+}
+
+// Record refreshes the gauges from a ZFSEncryptionInventory result. It
+// resets all three vectors first, so a dataset that was destroyed or
+// renamed since the previous call does not keep exporting its last-known
+// value forever.
+func (m *EncryptionMetrics) Record(inventory map[string]DatasetEncryptionInfo) {
+	m.Enabled.Reset()
+	m.KeyAvailable.Reset()
+	m.EncryptionRoot.Reset()
+	for ds, info := range inventory {
+		m.Enabled.WithLabelValues(ds).Set(boolToFloat64(info.Enabled()))
+		m.KeyAvailable.WithLabelValues(ds).Set(boolToFloat64(info.KeyAvailable()))
+		m.EncryptionRoot.WithLabelValues(ds).Set(boolToFloat64(info.EncryptionRoot == ds))
+	}
+}
+
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
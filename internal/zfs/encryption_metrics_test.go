@@ -0,0 +1,40 @@
+package zfs
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEncryptionMetricsRecordPrunesStaleDatasets(t *testing.T) {
+	m := NewEncryptionMetrics()
+
+	m.Record(map[string]DatasetEncryptionInfo{
+		"tank/old": {Encryption: "aes-256-gcm", KeyStatus: "available", EncryptionRoot: "tank/old"},
+	})
+	if n := testutilCollect(m.KeyAvailable); n != 1 {
+		t.Fatalf("after first Record: %d series, want 1", n)
+	}
+
+	// tank/old was destroyed; the next inventory no longer mentions it.
+	m.Record(map[string]DatasetEncryptionInfo{
+		"tank/new": {Encryption: "aes-256-gcm", KeyStatus: "unavailable", EncryptionRoot: "tank/new"},
+	})
+	if n := testutilCollect(m.KeyAvailable); n != 1 {
+		t.Errorf("after second Record: %d series, want 1 (stale tank/old series must be pruned)", n)
+	}
+}
+
+// testutilCollect counts the series currently exported by a collector,
+// without pulling in the client_golang/prometheus/testutil package for a
+// single counter.
+func testutilCollect(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 64)
+	c.Collect(ch)
+	close(ch)
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}